@@ -0,0 +1,346 @@
+// Copyright 2017 The WPT Dashboard Project. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package shared
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// resultsCacheSize bounds the number of distinct result URLs the default
+// fetcher's in-process LRU cache will retain.
+const resultsCacheSize = 32
+
+// ResultsFetcher abstracts how the raw results JSON bytes for a run are
+// retrieved, so this package doesn't hard-depend on the AppEngine standard
+// environment's urlfetch service (which isn't available in local dev, Cloud
+// Run, or tests).
+type ResultsFetcher interface {
+	Fetch(ctx context.Context, url string) ([]byte, error)
+}
+
+// StreamingResultsFetcher is implemented by ResultsFetcher implementations
+// that can hand back the response body unbuffered, so a caller like
+// StreamRunResultsJSON can decode directly off the network connection instead
+// of reading the whole (possibly multi-megabyte) body into memory before
+// parsing a single token. The caller is responsible for closing the returned
+// io.ReadCloser. Implementations that must buffer the whole body anyway (e.g.
+// CachingResultsFetcher, which needs the bytes to populate its cache) don't
+// implement this, and callers fall back to the buffered Fetch in that case.
+type StreamingResultsFetcher interface {
+	FetchStream(ctx context.Context, url string) (io.ReadCloser, error)
+}
+
+// conditionalFetcher is implemented by ResultsFetcher implementations that can
+// perform a conditional GET. It's an optional upgrade: CachingResultsFetcher
+// uses it when available to avoid re-downloading a run's results when the
+// server reports (via ETag) that they haven't changed, and falls back to a
+// plain Fetch otherwise.
+type conditionalFetcher interface {
+	FetchConditional(ctx context.Context, url, ifNoneMatch string) (body []byte, etag string, notModified bool, err error)
+}
+
+// AppEngineResultsFetcher fetches via the AppEngine standard-environment
+// urlfetch service. It's the default ResultsFetcher used when no other
+// ResultsFetcher has been attached to the context.
+type AppEngineResultsFetcher struct{}
+
+// Fetch implements ResultsFetcher.
+func (AppEngineResultsFetcher) Fetch(ctx context.Context, url string) ([]byte, error) {
+	body, _, _, err := doFetch(ctx, urlfetch.Client(ctx), url, "")
+	return body, err
+}
+
+// FetchConditional implements conditionalFetcher.
+func (AppEngineResultsFetcher) FetchConditional(
+	ctx context.Context, url, ifNoneMatch string) ([]byte, string, bool, error) {
+	return doFetch(ctx, urlfetch.Client(ctx), url, ifNoneMatch)
+}
+
+// FetchStream implements StreamingResultsFetcher.
+func (AppEngineResultsFetcher) FetchStream(ctx context.Context, url string) (io.ReadCloser, error) {
+	return doFetchStream(ctx, urlfetch.Client(ctx), url)
+}
+
+// HTTPResultsFetcher fetches via a plain net/http client, for environments
+// that don't have the AppEngine urlfetch service available (local dev, Cloud
+// Run, tests). A nil Client uses http.DefaultClient.
+type HTTPResultsFetcher struct {
+	Client *http.Client
+}
+
+// Fetch implements ResultsFetcher.
+func (f HTTPResultsFetcher) Fetch(ctx context.Context, url string) ([]byte, error) {
+	body, _, _, err := doFetch(ctx, f.client(), url, "")
+	return body, err
+}
+
+// FetchConditional implements conditionalFetcher.
+func (f HTTPResultsFetcher) FetchConditional(
+	ctx context.Context, url, ifNoneMatch string) ([]byte, string, bool, error) {
+	return doFetch(ctx, f.client(), url, ifNoneMatch)
+}
+
+// FetchStream implements StreamingResultsFetcher.
+func (f HTTPResultsFetcher) FetchStream(ctx context.Context, url string) (io.ReadCloser, error) {
+	return doFetchStream(ctx, f.client(), url)
+}
+
+func (f HTTPResultsFetcher) client() *http.Client {
+	if f.Client != nil {
+		return f.Client
+	}
+	return http.DefaultClient
+}
+
+func doFetch(ctx context.Context, client *http.Client, url, ifNoneMatch string) (
+	body []byte, etag string, notModified bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, ifNoneMatch, true, nil
+	}
+
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return nil, "", false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", false, fmt.Errorf("%s returned HTTP status %d:\n%s", url, resp.StatusCode, string(body))
+	}
+	return body, resp.Header.Get("ETag"), false, nil
+}
+
+// doFetchStream is like doFetch but, on a 200 response, hands back the
+// response body unread instead of buffering it, so the caller can decode
+// directly off the network. The caller must close the returned body. Non-200
+// responses are still buffered here (their bodies are small error pages, not
+// the multi-megabyte blobs this exists to avoid buffering).
+func doFetchStream(ctx context.Context, client *http.Client, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s returned HTTP status %d:\n%s", url, resp.StatusCode, string(body))
+	}
+	return resp.Body, nil
+}
+
+// cachedResult is a single CachingResultsFetcher cache entry.
+type cachedResult struct {
+	etag string
+	body []byte
+}
+
+// CachingResultsFetcher wraps another ResultsFetcher with an in-process LRU
+// cache keyed by URL (storing the response's ETag alongside the body), so
+// repeated diff requests against the same baseline run's results don't
+// re-download the same multi-megabyte JSON blob. When the wrapped fetcher
+// supports conditional requests, a cache hit is revalidated with the stored
+// ETag instead of being served unconditionally. It also implements
+// StreamingResultsFetcher (see FetchStream), so wrapping a fetcher in a cache
+// doesn't force every caller onto the buffered Fetch path.
+type CachingResultsFetcher struct {
+	fetcher ResultsFetcher
+	cache   *lru.Cache
+}
+
+// NewCachingResultsFetcher wraps fetcher with an LRU cache holding up to size
+// distinct URLs.
+func NewCachingResultsFetcher(fetcher ResultsFetcher, size int) *CachingResultsFetcher {
+	cache, err := lru.New(size)
+	if err != nil {
+		// lru.New only errors for a non-positive size, which is a caller bug.
+		panic(err)
+	}
+	return &CachingResultsFetcher{fetcher: fetcher, cache: cache}
+}
+
+// Fetch implements ResultsFetcher.
+func (c *CachingResultsFetcher) Fetch(ctx context.Context, url string) ([]byte, error) {
+	cf, canRevalidate := c.fetcher.(conditionalFetcher)
+
+	cached, hit := c.cache.Get(url)
+	var prevEntry cachedResult
+	if hit {
+		prevEntry = cached.(cachedResult)
+		if !canRevalidate {
+			return prevEntry.body, nil
+		}
+	}
+
+	if canRevalidate {
+		body, etag, notModified, err := cf.FetchConditional(ctx, url, prevEntry.etag)
+		if err != nil {
+			return nil, err
+		}
+		if notModified {
+			return prevEntry.body, nil
+		}
+		c.cache.Add(url, cachedResult{etag: etag, body: body})
+		return body, nil
+	}
+
+	body, err := c.fetcher.Fetch(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.Add(url, cachedResult{body: body})
+	return body, nil
+}
+
+// FetchStream implements StreamingResultsFetcher, so caching and streaming
+// aren't mutually exclusive: StreamRunResultsJSON can still decode directly
+// off the network even through the default (caching) fetcher.
+//
+// On a cache hit that can't be cheaply revalidated, the cached body is served
+// as a stream with no network access. On a hit that can be revalidated, or on
+// a miss where the wrapped fetcher doesn't support streaming, this falls back
+// to the buffered Fetch path and wraps its result as a stream. On a genuine
+// miss against a streaming-capable wrapped fetcher — the common case, a diff
+// request's first fetch of a given baseline run — the wrapped fetcher's live
+// stream is teed into the cache as the caller reads it, so the decoder still
+// gets bytes straight off the network while the cache is populated for the
+// next call.
+func (c *CachingResultsFetcher) FetchStream(ctx context.Context, url string) (io.ReadCloser, error) {
+	if cached, hit := c.cache.Get(url); hit {
+		if _, canRevalidate := c.fetcher.(conditionalFetcher); !canRevalidate {
+			return ioutil.NopCloser(bytes.NewReader(cached.(cachedResult).body)), nil
+		}
+		body, err := c.Fetch(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	sf, ok := c.fetcher.(StreamingResultsFetcher)
+	if !ok {
+		body, err := c.Fetch(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	stream, err := sf.FetchStream(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	return &cacheTeeingStream{
+		tee:    io.TeeReader(stream, buf),
+		stream: stream,
+		buf:    buf,
+		cache:  c.cache,
+		url:    url,
+	}, nil
+}
+
+// cacheTeeingStream wraps a live network stream, copying every byte read from
+// it into buf, and — only once the stream has been read to completion —
+// commits buf to the cache on Close. A stream that's closed early (the caller
+// erred out partway through decoding) is simply not cached, rather than
+// caching a truncated body.
+type cacheTeeingStream struct {
+	tee    io.Reader
+	stream io.ReadCloser
+	buf    *bytes.Buffer
+	cache  *lru.Cache
+	url    string
+	eof    bool
+}
+
+func (s *cacheTeeingStream) Read(p []byte) (int, error) {
+	n, err := s.tee.Read(p)
+	if err == io.EOF {
+		s.eof = true
+	}
+	return n, err
+}
+
+func (s *cacheTeeingStream) Close() error {
+	if s.eof {
+		s.cache.Add(s.url, cachedResult{body: append([]byte(nil), s.buf.Bytes()...)})
+	}
+	return s.stream.Close()
+}
+
+// defaultResultsFetcher is used by ResultsFetcherFromContext when no
+// ResultsFetcher has been attached to the context.
+var defaultResultsFetcher ResultsFetcher = NewCachingResultsFetcher(AppEngineResultsFetcher{}, resultsCacheSize)
+
+type resultsFetcherContextKey struct{}
+
+// WithResultsFetcher attaches f to ctx, to be retrieved later via
+// ResultsFetcherFromContext. This lets callers swap in an HTTPResultsFetcher
+// or FakeResultsFetcher without changing the signatures of
+// FetchRunResultsJSON and friends.
+func WithResultsFetcher(ctx context.Context, f ResultsFetcher) context.Context {
+	return context.WithValue(ctx, resultsFetcherContextKey{}, f)
+}
+
+// ResultsFetcherFromContext returns the ResultsFetcher attached to ctx via
+// WithResultsFetcher, falling back to the cached AppEngine urlfetch-based
+// fetcher when none was attached.
+func ResultsFetcherFromContext(ctx context.Context) ResultsFetcher {
+	if f, ok := ctx.Value(resultsFetcherContextKey{}).(ResultsFetcher); ok {
+		return f
+	}
+	return defaultResultsFetcher
+}
+
+// FakeResultsFetcher is a ResultsFetcher (and StreamingResultsFetcher) for
+// tests: it returns canned bytes (or an error) per URL without making any
+// network calls.
+type FakeResultsFetcher struct {
+	Responses map[string][]byte
+	Errors    map[string]error
+}
+
+// Fetch implements ResultsFetcher.
+func (f FakeResultsFetcher) Fetch(ctx context.Context, url string) ([]byte, error) {
+	if err, ok := f.Errors[url]; ok {
+		return nil, err
+	}
+	if body, ok := f.Responses[url]; ok {
+		return body, nil
+	}
+	return nil, fmt.Errorf("FakeResultsFetcher: no response registered for %s", url)
+}
+
+// FetchStream implements StreamingResultsFetcher.
+func (f FakeResultsFetcher) FetchStream(ctx context.Context, url string) (io.ReadCloser, error) {
+	body, err := f.Fetch(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(body)), nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2017 The WPT Dashboard Project. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package shared
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// countingStreamFetcher is a test-only ResultsFetcher + StreamingResultsFetcher
+// that counts how many times the underlying "network" was actually touched,
+// so tests can assert on whether CachingResultsFetcher served a request from
+// its cache instead of refetching.
+type countingStreamFetcher struct {
+	body  []byte
+	calls int
+}
+
+func (f *countingStreamFetcher) Fetch(ctx context.Context, url string) ([]byte, error) {
+	f.calls++
+	return f.body, nil
+}
+
+func (f *countingStreamFetcher) FetchStream(ctx context.Context, url string) (io.ReadCloser, error) {
+	f.calls++
+	return ioutil.NopCloser(bytes.NewReader(f.body)), nil
+}
+
+// countingConditionalFetcher is a test-only ResultsFetcher + conditionalFetcher
+// that serves whatever (body, etag) is currently registered for each URL and
+// records each call (a Fetch count, and the If-None-Match value passed on each
+// FetchConditional call), so tests can assert on
+// CachingResultsFetcher's hit/miss/304/etag-changed behavior without a real
+// network round-trip.
+type countingConditionalFetcher struct {
+	bodies       map[string][]byte
+	etags        map[string]string
+	fetchCalls   int
+	conditionals []string // the ifNoneMatch value passed on each FetchConditional call
+}
+
+func (f *countingConditionalFetcher) Fetch(ctx context.Context, url string) ([]byte, error) {
+	f.fetchCalls++
+	return f.bodies[url], nil
+}
+
+func (f *countingConditionalFetcher) FetchConditional(
+	ctx context.Context, url, ifNoneMatch string) ([]byte, string, bool, error) {
+	f.conditionals = append(f.conditionals, ifNoneMatch)
+	etag := f.etags[url]
+	if ifNoneMatch != "" && ifNoneMatch == etag {
+		return nil, etag, true, nil
+	}
+	return f.bodies[url], etag, false, nil
+}
+
+func TestCachingResultsFetcher_MissThenHitRevalidates(t *testing.T) {
+	inner := &countingConditionalFetcher{
+		bodies: map[string][]byte{"u": []byte(`{"a":[1,1]}`)},
+		etags:  map[string]string{"u": "etag-1"},
+	}
+	c := NewCachingResultsFetcher(inner, 8)
+
+	body, err := c.Fetch(context.Background(), "u")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"a":[1,1]}`), body)
+	assert.Equal(t, []string{""}, inner.conditionals, "first fetch should send no If-None-Match")
+
+	body, err = c.Fetch(context.Background(), "u")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"a":[1,1]}`), body)
+	assert.Equal(t, []string{"", "etag-1"}, inner.conditionals, "second fetch should revalidate with the stored ETag")
+}
+
+func TestCachingResultsFetcher_NotModifiedServesCachedBody(t *testing.T) {
+	inner := &countingConditionalFetcher{
+		bodies: map[string][]byte{"u": []byte(`{"a":[1,1]}`)},
+		etags:  map[string]string{"u": "etag-1"},
+	}
+	c := NewCachingResultsFetcher(inner, 8)
+
+	first, err := c.Fetch(context.Background(), "u")
+	assert.NoError(t, err)
+
+	// Simulate the upstream content changing without the ETag changing on the
+	// fetcher's side being irrelevant: the server will report 304 for a
+	// matching ETag, and the cached body must be served unchanged.
+	inner.bodies["u"] = []byte(`{"a":[9,9]}`)
+
+	second, err := c.Fetch(context.Background(), "u")
+	assert.NoError(t, err)
+	assert.Equal(t, first, second, "a 304 response should serve the previously cached body")
+}
+
+func TestCachingResultsFetcher_ETagChangedRefetches(t *testing.T) {
+	inner := &countingConditionalFetcher{
+		bodies: map[string][]byte{"u": []byte(`{"a":[1,1]}`)},
+		etags:  map[string]string{"u": "etag-1"},
+	}
+	c := NewCachingResultsFetcher(inner, 8)
+
+	first, err := c.Fetch(context.Background(), "u")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"a":[1,1]}`), first)
+
+	inner.bodies["u"] = []byte(`{"a":[2,2]}`)
+	inner.etags["u"] = "etag-2"
+
+	second, err := c.Fetch(context.Background(), "u")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"a":[2,2]}`), second, "a changed ETag should return the new body")
+}
+
+func TestCachingResultsFetcher_NonConditionalFetcherCachesUnconditionally(t *testing.T) {
+	inner := FakeResultsFetcher{Responses: map[string][]byte{"u": []byte(`{"a":[1,1]}`)}}
+	c := NewCachingResultsFetcher(inner, 8)
+
+	first, err := c.Fetch(context.Background(), "u")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"a":[1,1]}`), first)
+
+	// FakeResultsFetcher doesn't implement conditionalFetcher, so a cache hit
+	// must be served without calling back into the fetcher at all, even if
+	// its canned response has since changed.
+	inner.Responses["u"] = []byte(`{"a":[9,9]}`)
+
+	second, err := c.Fetch(context.Background(), "u")
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+}
+
+func TestFakeResultsFetcher_FetchStream(t *testing.T) {
+	f := FakeResultsFetcher{Responses: map[string][]byte{"u": []byte("hello")}}
+	stream, err := f.FetchStream(context.Background(), "u")
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	buf := make([]byte, 5)
+	n, err := stream.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+}
+
+func TestFakeResultsFetcher_UnregisteredURLErrors(t *testing.T) {
+	f := FakeResultsFetcher{}
+	_, err := f.Fetch(context.Background(), "missing")
+	assert.Error(t, err)
+}
+
+func TestCachingResultsFetcher_FetchStreamPopulatesCache(t *testing.T) {
+	inner := &countingStreamFetcher{body: []byte(`{"a":[1,1]}`)}
+	c := NewCachingResultsFetcher(inner, 8)
+
+	stream, err := c.FetchStream(context.Background(), "u")
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(stream)
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Close())
+	assert.Equal(t, inner.body, got)
+	assert.Equal(t, 1, inner.calls)
+
+	// A subsequent Fetch should be served from the cache FetchStream
+	// populated as it was read, without touching the wrapped fetcher again.
+	cached, err := c.Fetch(context.Background(), "u")
+	assert.NoError(t, err)
+	assert.Equal(t, inner.body, cached)
+	assert.Equal(t, 1, inner.calls, "cache should already have been populated by FetchStream's tee")
+}
+
+func TestCachingResultsFetcher_FetchStreamNotCachedIfClosedEarly(t *testing.T) {
+	inner := &countingStreamFetcher{body: []byte(`{"a":[1,1],"b":[2,2]}`)}
+	c := NewCachingResultsFetcher(inner, 8)
+
+	stream, err := c.FetchStream(context.Background(), "u")
+	assert.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = stream.Read(buf)
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Close()) // Closed before reaching EOF.
+
+	_, hit := c.cache.Get("u")
+	assert.False(t, hit, "closing a stream before EOF should not populate the cache")
+}
+
+func TestCachingResultsFetcher_FetchStreamServesCacheHitWithoutNetwork(t *testing.T) {
+	inner := &countingStreamFetcher{body: []byte(`{"a":[1,1]}`)}
+	c := NewCachingResultsFetcher(inner, 8)
+
+	first, err := c.FetchStream(context.Background(), "u")
+	assert.NoError(t, err)
+	_, _ = ioutil.ReadAll(first)
+	assert.NoError(t, first.Close())
+	assert.Equal(t, 1, inner.calls)
+
+	second, err := c.FetchStream(context.Background(), "u")
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(second)
+	assert.NoError(t, err)
+	assert.NoError(t, second.Close())
+	assert.Equal(t, inner.body, got)
+	assert.Equal(t, 1, inner.calls, "a cache hit with a non-revalidating fetcher shouldn't touch the network again")
+}
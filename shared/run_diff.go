@@ -5,18 +5,33 @@
 package shared
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
 	mapset "github.com/deckarep/golang-set"
 	"golang.org/x/net/context"
-	"google.golang.org/appengine/urlfetch"
+	"golang.org/x/sync/errgroup"
 )
 
+// StreamRunResultsJSONSizeHint sizes the map StreamRunResultsJSON's
+// FetchRunResultsJSON wrapper preallocates, chosen to roughly match a full WPT
+// run without grossly over-allocating for smaller ones.
+const StreamRunResultsJSONSizeHint = 25000
+
+// DefaultFetchConcurrency is the default number of concurrent result fetches
+// performed by FetchRunResultsJSONForSpecs/FetchRunResultsJSONForParams.
+const DefaultFetchConcurrency = 8
+
+// DefaultFetchTimeout bounds the overall time spent fetching a batch of runs.
+const DefaultFetchTimeout = time.Minute
+
 // FetchRunResultsJSONForParam fetches the results JSON blob for the given [product]@[SHA] param.
 func FetchRunResultsJSONForParam(
 	ctx context.Context, r *http.Request, param string) (results map[string][]int, err error) {
@@ -47,6 +62,69 @@ func FetchRunResultsJSONForSpec(
 	return FetchRunResultsJSON(ctx, r, *run)
 }
 
+// FetchRunResultsJSONForSpecs fetches the result JSON blobs for the given specs in parallel,
+// bounded by concurrency (DefaultFetchConcurrency if concurrency <= 0) and an overall deadline
+// of DefaultFetchTimeout. The first fetch to fail cancels the rest. Results are returned in the
+// same order as specs.
+//
+// This checkout has no api package for a diff handler to call it from; wiring
+// a diff endpoint to use this instead of two serial FetchRunResultsJSONForSpec
+// calls is follow-up work, not dropped.
+func FetchRunResultsJSONForSpecs(
+	ctx context.Context, r *http.Request, specs []ProductSpec, concurrency int) ([]map[string][]int, error) {
+	return fetchResultsJSONParallel(ctx, concurrency, len(specs), func(ctx context.Context, i int) (map[string][]int, error) {
+		return FetchRunResultsJSONForSpec(ctx, r, specs[i])
+	})
+}
+
+// FetchRunResultsJSONForParams fetches the results JSON blobs for the given [product]@[SHA]
+// params in parallel. See FetchRunResultsJSONForSpecs for concurrency/cancellation semantics.
+func FetchRunResultsJSONForParams(
+	ctx context.Context, r *http.Request, params []string, concurrency int) ([]map[string][]int, error) {
+	return fetchResultsJSONParallel(ctx, concurrency, len(params), func(ctx context.Context, i int) (map[string][]int, error) {
+		return FetchRunResultsJSONForParam(ctx, r, params[i])
+	})
+}
+
+// fetchResultsJSONParallel runs fetch(ctx, i) for i in [0, n) concurrently, bounded by
+// concurrency (DefaultFetchConcurrency if concurrency <= 0) and an overall deadline of
+// DefaultFetchTimeout, cancelling the rest on the first error. Results are returned in input order.
+func fetchResultsJSONParallel(
+	ctx context.Context, concurrency int, n int,
+	fetch func(ctx context.Context, i int) (map[string][]int, error)) ([]map[string][]int, error) {
+	if concurrency <= 0 {
+		concurrency = DefaultFetchConcurrency
+	}
+	ctx, cancel := context.WithTimeout(ctx, DefaultFetchTimeout)
+	defer cancel()
+
+	g, ctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, concurrency)
+	results := make([]map[string][]int, n)
+	for i := 0; i < n; i++ {
+		i := i
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-sem }()
+
+			result, err := fetch(ctx, i)
+			if err != nil {
+				return err
+			}
+			results[i] = result
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
 // FetchRunForSpec loads the wpt.fyi TestRun metadata for the given spec.
 func FetchRunForSpec(ctx context.Context, spec ProductSpec) (*TestRun, error) {
 	one := 1
@@ -64,29 +142,103 @@ func FetchRunForSpec(ctx context.Context, spec ProductSpec) (*TestRun, error) {
 	return nil, nil
 }
 
-// FetchRunResultsJSON fetches the results JSON summary for the given test run, but does not include subtests (since
-// a full run can span 20k files).
-func FetchRunResultsJSON(ctx context.Context, r *http.Request, run TestRun) (results map[string][]int, err error) {
-	client := urlfetch.Client(ctx)
+// StreamRunResultsJSON fetches the results JSON summary for run (which does not
+// include subtests, since a full run can span 20k files) and streams its
+// entries to fn as they're decoded. When the resolved ResultsFetcher
+// implements StreamingResultsFetcher — true of the default fetcher too, via
+// CachingResultsFetcher.FetchStream — entries are decoded directly off the
+// network connection on a genuine cache miss, so the whole blob is never
+// buffered in memory and parsing overlaps with the read; fn can also drop
+// entries (e.g. ones that don't match a path filter, as
+// FetchRunResultsJSONForPaths does) before they're ever retained. Only a
+// ResultsFetcher that can't stream at all (no StreamingResultsFetcher
+// implementation) falls back to decoding from an already-buffered slice.
+// Returning a non-nil error from fn aborts decoding and is returned as-is.
+func StreamRunResultsJSON(
+	ctx context.Context, r *http.Request, run TestRun, fn func(test string, counts []int) error) error {
 	url := strings.TrimSpace(run.ResultsURL)
 	if strings.Index(url, "/") == 0 {
 		reqURL := *r.URL
 		reqURL.Path = url
+		url = reqURL.String()
 	}
-	var resp *http.Response
-	if resp, err = client.Get(url); err != nil {
-		return nil, err
+
+	fetcher := ResultsFetcherFromContext(ctx)
+	var src io.Reader
+	if sf, ok := fetcher.(StreamingResultsFetcher); ok {
+		stream, err := sf.FetchStream(ctx, url)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		src = stream
+	} else {
+		body, err := fetcher.Fetch(ctx, url)
+		if err != nil {
+			return err
+		}
+		src = bytes.NewReader(body)
 	}
-	defer resp.Body.Close()
 
-	var body []byte
-	if body, err = ioutil.ReadAll(resp.Body); err != nil {
-		return nil, err
+	dec := json.NewDecoder(src)
+	if _, err := dec.Token(); err != nil { // Consume the opening '{'.
+		return err
 	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("%s returned HTTP status %d:\n%s", url, resp.StatusCode, string(body))
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		test, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a test name, got %v", url, tok)
+		}
+		var counts []int
+		if err := dec.Decode(&counts); err != nil {
+			return err
+		}
+		if err := fn(test, counts); err != nil {
+			return err
+		}
+	}
+	// The decoder stops as soon as the object is complete; read the rest of the
+	// source through to EOF so a CachingResultsFetcher stream sees the whole
+	// body and commits it to its cache on Close.
+	if _, err := io.Copy(ioutil.Discard, src); err != nil {
+		return err
 	}
-	if err = json.Unmarshal(body, &results); err != nil {
+	return nil
+}
+
+// FetchRunResultsJSON fetches the results JSON summary for the given test run, but does not include subtests (since
+// a full run can span 20k files). It's a thin wrapper over StreamRunResultsJSON for callers that want the whole map.
+func FetchRunResultsJSON(ctx context.Context, r *http.Request, run TestRun) (results map[string][]int, err error) {
+	results = make(map[string][]int, StreamRunResultsJSONSizeHint)
+	err = StreamRunResultsJSON(ctx, r, run, func(test string, counts []int) error {
+		results[test] = counts
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// FetchRunResultsJSONForPaths is like FetchRunResultsJSON, but discards any
+// entry whose test name doesn't match paths before it's added to the returned
+// map (via StreamRunResultsJSON), so a path-scoped diff doesn't retain results
+// outside of its scope. Every entry is still decoded before it's filtered.
+func FetchRunResultsJSONForPaths(
+	ctx context.Context, r *http.Request, run TestRun, paths mapset.Set) (results map[string][]int, err error) {
+	results = make(map[string][]int, StreamRunResultsJSONSizeHint)
+	err = StreamRunResultsJSON(ctx, r, run, func(test string, counts []int) error {
+		if !anyPathMatches(paths, test) {
+			return nil
+		}
+		results[test] = counts
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 	return results, nil
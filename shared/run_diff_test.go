@@ -0,0 +1,175 @@
+// Copyright 2017 The WPT Dashboard Project. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package shared
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// recordingFetcher is a test-only ResultsFetcher that tracks how many Fetch
+// calls are in flight at once (to assert on concurrency bounds), can delay
+// per-URL (to control fetch ordering), can fail per-URL, and honors ctx
+// cancellation instead of blocking forever.
+type recordingFetcher struct {
+	mu          sync.Mutex
+	current     int
+	maxObserved int
+
+	bodies map[string][]byte
+	fail   map[string]error
+	delay  func(url string) time.Duration
+}
+
+func (f *recordingFetcher) Fetch(ctx context.Context, url string) ([]byte, error) {
+	f.mu.Lock()
+	f.current++
+	if f.current > f.maxObserved {
+		f.maxObserved = f.current
+	}
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.current--
+		f.mu.Unlock()
+	}()
+
+	if err, ok := f.fail[url]; ok {
+		return nil, err
+	}
+
+	var wait time.Duration
+	if f.delay != nil {
+		wait = f.delay(url)
+	}
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return f.bodies[url], nil
+}
+
+// paramFor builds a FetchRunResultsJSONForParam-compatible base64-encoded
+// TestRun param for the given results URL.
+func paramFor(t *testing.T, url string) string {
+	t.Helper()
+	b, err := json.Marshal(TestRun{ResultsURL: url})
+	assert.NoError(t, err)
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+func TestFetchRunResultsJSONForParams_PreservesOrder(t *testing.T) {
+	urls := []string{"http://a.test", "http://b.test", "http://c.test", "http://d.test"}
+	// Latencies are deliberately out of input order, so the result slice can
+	// only be in input order if the fan-out code places each result at its
+	// own index rather than, say, appending in completion order.
+	delays := map[string]time.Duration{
+		"http://a.test": 30 * time.Millisecond,
+		"http://b.test": 0,
+		"http://c.test": 20 * time.Millisecond,
+		"http://d.test": 10 * time.Millisecond,
+	}
+	bodies := map[string][]byte{}
+	for _, u := range urls {
+		bodies[u] = []byte(fmt.Sprintf(`{"%s":[1,1]}`, u))
+	}
+	fetcher := &recordingFetcher{
+		bodies: bodies,
+		delay:  func(url string) time.Duration { return delays[url] },
+	}
+	ctx := WithResultsFetcher(context.Background(), fetcher)
+	r := &http.Request{}
+
+	params := make([]string, len(urls))
+	for i, u := range urls {
+		params[i] = paramFor(t, u)
+	}
+
+	results, err := FetchRunResultsJSONForParams(ctx, r, params, 0)
+	assert.NoError(t, err)
+	assert.Len(t, results, len(urls))
+	for i, u := range urls {
+		_, ok := results[i][u]
+		assert.True(t, ok, "result %d should be for %s despite differing fetch latencies", i, u)
+	}
+}
+
+func TestFetchRunResultsJSONForParams_BoundsConcurrency(t *testing.T) {
+	const concurrency = 3
+	const n = 10
+
+	urls := make([]string, n)
+	bodies := map[string][]byte{}
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://host-%d.test", i)
+		bodies[urls[i]] = []byte(`{}`)
+	}
+	fetcher := &recordingFetcher{
+		bodies: bodies,
+		delay:  func(string) time.Duration { return 20 * time.Millisecond },
+	}
+	ctx := WithResultsFetcher(context.Background(), fetcher)
+	r := &http.Request{}
+
+	params := make([]string, n)
+	for i, u := range urls {
+		params[i] = paramFor(t, u)
+	}
+
+	_, err := FetchRunResultsJSONForParams(ctx, r, params, concurrency)
+	assert.NoError(t, err)
+
+	fetcher.mu.Lock()
+	defer fetcher.mu.Unlock()
+	assert.LessOrEqual(t, fetcher.maxObserved, concurrency, "semaphore should cap in-flight fetches at concurrency")
+	assert.Greater(t, fetcher.maxObserved, 1, "concurrency should actually be exercised, not accidentally serialized")
+}
+
+func TestFetchRunResultsJSONForParams_FirstErrorCancelsRest(t *testing.T) {
+	urls := []string{"http://ok-1.test", "http://fails.test", "http://ok-2.test", "http://ok-3.test"}
+	bodies := map[string][]byte{}
+	for _, u := range urls {
+		bodies[u] = []byte(`{}`)
+	}
+	wantErr := errors.New("boom")
+	fetcher := &recordingFetcher{
+		bodies: bodies,
+		fail:   map[string]error{"http://fails.test": wantErr},
+		// The "ok" fetches would hang indefinitely if not cancelled; only a
+		// ctx.Done() firing from the shared errgroup context lets them return.
+		delay: func(string) time.Duration { return time.Hour },
+	}
+	ctx := WithResultsFetcher(context.Background(), fetcher)
+	r := &http.Request{}
+
+	params := make([]string, len(urls))
+	for i, u := range urls {
+		params[i] = paramFor(t, u)
+	}
+
+	done := make(chan struct{})
+	var err error
+	go func() {
+		_, err = FetchRunResultsJSONForParams(ctx, r, params, 0)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("FetchRunResultsJSONForParams did not return promptly; the first error should cancel the rest")
+	}
+	assert.ErrorIs(t, err, wantErr)
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 The WPT Dashboard Project. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package shared
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMyersDiff_Identical(t *testing.T) {
+	ops, ok := myersDiff([]string{"a", "b", "c"}, []string{"a", "b", "c"}, 0)
+	assert.True(t, ok)
+	assert.Equal(t, []diffOp{
+		{kind: diffOpEqual, aIdx: 0, bIdx: 0},
+		{kind: diffOpEqual, aIdx: 1, bIdx: 1},
+		{kind: diffOpEqual, aIdx: 2, bIdx: 2},
+	}, ops)
+}
+
+func TestMyersDiff_InsertInMiddle(t *testing.T) {
+	ops, ok := myersDiff([]string{"a", "b", "c"}, []string{"a", "x", "b", "c"}, 0)
+	assert.True(t, ok)
+	assert.Equal(t, []diffOp{
+		{kind: diffOpEqual, aIdx: 0, bIdx: 0},
+		{kind: diffOpInsert, bIdx: 1},
+		{kind: diffOpEqual, aIdx: 1, bIdx: 2},
+		{kind: diffOpEqual, aIdx: 2, bIdx: 3},
+	}, ops)
+}
+
+func TestMyersDiff_DeleteInMiddle(t *testing.T) {
+	ops, ok := myersDiff([]string{"a", "b", "c"}, []string{"a", "c"}, 0)
+	assert.True(t, ok)
+	assert.Equal(t, []diffOp{
+		{kind: diffOpEqual, aIdx: 0, bIdx: 0},
+		{kind: diffOpDelete, aIdx: 1},
+		{kind: diffOpEqual, aIdx: 2, bIdx: 1},
+	}, ops)
+}
+
+func TestMyersDiff_ReplaceInMiddle(t *testing.T) {
+	// A single substitution in the middle should cost exactly one delete and
+	// one insert, not cascade into re-pairing every subsequent name.
+	ops, ok := myersDiff([]string{"a", "b", "c"}, []string{"a", "x", "c"}, 0)
+	assert.True(t, ok)
+	assert.Equal(t, []diffOp{
+		{kind: diffOpEqual, aIdx: 0, bIdx: 0},
+		{kind: diffOpDelete, aIdx: 1},
+		{kind: diffOpInsert, bIdx: 1},
+		{kind: diffOpEqual, aIdx: 2, bIdx: 2},
+	}, ops)
+}
+
+func TestMyersDiff_EmptyInputs(t *testing.T) {
+	ops, ok := myersDiff(nil, nil, 0)
+	assert.True(t, ok)
+	assert.Empty(t, ops)
+
+	ops, ok = myersDiff(nil, []string{"a"}, 0)
+	assert.True(t, ok)
+	assert.Equal(t, []diffOp{{kind: diffOpInsert, bIdx: 0}}, ops)
+
+	ops, ok = myersDiff([]string{"a"}, nil, 0)
+	assert.True(t, ok)
+	assert.Equal(t, []diffOp{{kind: diffOpDelete, aIdx: 0}}, ops)
+}
+
+func TestMyersDiff_MaxDBoundary(t *testing.T) {
+	// Edit distance between these is exactly 2 (delete "b", insert "x").
+	a := []string{"a", "b", "c"}
+	b := []string{"a", "x", "c"}
+
+	_, ok := myersDiff(a, b, 1)
+	assert.False(t, ok, "edit distance 2 should exceed maxD 1")
+
+	ops, ok := myersDiff(a, b, 2)
+	assert.True(t, ok, "edit distance 2 should be within maxD 2")
+	assert.Len(t, ops, 4)
+}
+
+func TestDiffSubtests_ClassifiesTransitions(t *testing.T) {
+	before := []SubtestResult{
+		{Name: "one", Status: "PASS"},
+		{Name: "two", Status: "FAIL"},
+		{Name: "three", Status: "PASS"},
+	}
+	after := []SubtestResult{
+		{Name: "one", Status: "PASS"},
+		{Name: "new", Status: "FAIL"},
+		{Name: "two", Status: "PASS"},
+		{Name: "three", Status: "FAIL"},
+	}
+
+	got := diffSubtests(before, after)
+	want := []SubtestTransition{
+		{Name: "one", BeforeStatus: "PASS", AfterStatus: "PASS", Kind: DiffKindUnchanged},
+		{Name: "new", AfterStatus: "FAIL", Kind: DiffKindAdded},
+		{Name: "two", BeforeStatus: "FAIL", AfterStatus: "PASS", Kind: DiffKindImproved},
+		{Name: "three", BeforeStatus: "PASS", AfterStatus: "FAIL", Kind: DiffKindRegressed},
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestDiffSubtests_FallsBackBeyondThreshold(t *testing.T) {
+	// Build two lists with no names in common, so the edit distance (2*N)
+	// exceeds subtestDiffThreshold and diffSubtests must use the map-based
+	// fallback instead of myersDiff.
+	n := subtestDiffThreshold + 1
+	before := make([]SubtestResult, n)
+	after := make([]SubtestResult, n)
+	for i := 0; i < n; i++ {
+		before[i] = SubtestResult{Name: "before-only", Status: "PASS"}
+		after[i] = SubtestResult{Name: "after-only", Status: "PASS"}
+	}
+
+	got := diffSubtests(before, after)
+	assert.Len(t, got, 2*n)
+	for _, tr := range got {
+		if tr.Name == "before-only" {
+			assert.Equal(t, DiffKindRemoved, tr.Kind)
+		} else {
+			assert.Equal(t, DiffKindAdded, tr.Kind)
+		}
+	}
+}
+
+func TestGetSubtestResultsDiff_WholeFileAddedAndRemoved(t *testing.T) {
+	before := map[string]SubtestResults{
+		"/removed.html": {Subtests: []SubtestResult{{Name: "a", Status: "PASS"}}},
+	}
+	after := map[string]SubtestResults{
+		"/added.html": {Subtests: []SubtestResult{{Name: "a", Status: "FAIL"}}},
+	}
+	filter := DiffFilterParam{Added: true, Deleted: true, Changed: true, Unchanged: true}
+
+	diff := GetSubtestResultsDiff(before, after, filter, nil, nil)
+
+	removed, ok := diff["/removed.html"]
+	assert.True(t, ok, "expected the deleted file to appear in the diff")
+	assert.Equal(t, []SubtestTransition{{Name: "a", BeforeStatus: "PASS", Kind: DiffKindRemoved}}, removed.Subtests)
+
+	added, ok := diff["/added.html"]
+	assert.True(t, ok, "expected the newly-added file to appear in the diff")
+	assert.Equal(t, []SubtestTransition{{Name: "a", AfterStatus: "FAIL", Kind: DiffKindAdded}}, added.Subtests)
+}
+
+func TestGetSubtestResultsDiff_RespectsFilter(t *testing.T) {
+	before := map[string]SubtestResults{
+		"/removed.html": {Subtests: []SubtestResult{{Name: "a", Status: "PASS"}}},
+	}
+	after := map[string]SubtestResults{
+		"/added.html": {Subtests: []SubtestResult{{Name: "a", Status: "FAIL"}}},
+	}
+	filter := DiffFilterParam{} // Nothing requested.
+
+	diff := GetSubtestResultsDiff(before, after, filter, nil, nil)
+	assert.Empty(t, diff)
+}